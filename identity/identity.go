@@ -0,0 +1,170 @@
+// Package identity gives every client a long-lived ECDSA keypair and
+// derives its ClientID from that keypair, the way go-ethereum's p2p/discover
+// derives a node's NodeID from its public key, instead of the server handing
+// out an anonymous random ClientID that anyone who sniffs it can reuse.
+package identity
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+
+	"Lunnel/crypto"
+
+	"github.com/pkg/errors"
+)
+
+var curve = elliptic.P256()
+
+// Key is a client's long-lived node identity.
+type Key struct {
+	Priv *ecdsa.PrivateKey
+}
+
+// GenerateKey creates a fresh node identity keypair.
+func GenerateKey() (*Key, error) {
+	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "ecdsa.GenerateKey")
+	}
+	return &Key{Priv: priv}, nil
+}
+
+// ClientID derives this key's ClientID, the truncated SHA-256 hash of its
+// marshalled public key.
+func (k *Key) ClientID() crypto.UUID {
+	return PublicKeyToClientID(&k.Priv.PublicKey)
+}
+
+// Sign signs nonce with the key's private key, returning a fixed-width
+// (r||s) signature.
+func (k *Key) Sign(nonce []byte) ([]byte, error) {
+	hash := sha256.Sum256(nonce)
+	r, s, err := ecdsa.Sign(rand.Reader, k.Priv, hash[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "ecdsa.Sign")
+	}
+	return marshalSignature(r, s), nil
+}
+
+// PublicKeyHex hex-encodes the key's marshalled public key, for writing to
+// a known_clients allowlist file.
+func (k *Key) PublicKeyHex() string {
+	return hex.EncodeToString(elliptic.Marshal(curve, k.Priv.PublicKey.X, k.Priv.PublicKey.Y))
+}
+
+// PublicKeyToClientID derives a ClientID from a raw public key, the same
+// way Key.ClientID does for a local key.
+func PublicKeyToClientID(pub *ecdsa.PublicKey) crypto.UUID {
+	marshalled := elliptic.Marshal(curve, pub.X, pub.Y)
+	sum := sha256.Sum256(marshalled)
+	var id crypto.UUID
+	copy(id[:], sum[:len(id)])
+	return id
+}
+
+// Verify checks that sig is a valid signature over nonce by pub.
+func Verify(pub *ecdsa.PublicKey, nonce, sig []byte) bool {
+	r, s, ok := unmarshalSignature(sig)
+	if !ok {
+		return false
+	}
+	hash := sha256.Sum256(nonce)
+	return ecdsa.Verify(pub, hash[:], r, s)
+}
+
+// signatureLen is the byte length of one fixed-width r or s component for
+// the P256 curve used here.
+const signatureLen = 32
+
+func marshalSignature(r, s *big.Int) []byte {
+	buf := make([]byte, signatureLen*2)
+	copyPadded(buf[:signatureLen], r.Bytes())
+	copyPadded(buf[signatureLen:], s.Bytes())
+	return buf
+}
+
+// copyPadded right-aligns src into dst, left-padding with zero bytes.
+func copyPadded(dst, src []byte) {
+	copy(dst[len(dst)-len(src):], src)
+}
+
+func unmarshalSignature(sig []byte) (r, s *big.Int, ok bool) {
+	if len(sig) != signatureLen*2 {
+		return nil, nil, false
+	}
+	r = new(big.Int).SetBytes(sig[:signatureLen])
+	s = new(big.Int).SetBytes(sig[signatureLen:])
+	return r, s, true
+}
+
+// SaveKey writes priv's private scalar, hex-encoded, to path.
+//
+// No command-line subcommand in this tree calls SaveKey or GenerateKey; code
+// that embeds this package calls them directly.
+func SaveKey(k *Key, path string) error {
+	hexKey := hex.EncodeToString(k.Priv.D.Bytes())
+	return ioutil.WriteFile(path, []byte(hexKey), 0600)
+}
+
+// LoadKey reads back a private key written by SaveKey.
+func LoadKey(path string) (*Key, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read key file")
+	}
+	d, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return nil, errors.Wrap(err, "decode key file")
+	}
+	priv := new(ecdsa.PrivateKey)
+	priv.PublicKey.Curve = curve
+	priv.D = new(big.Int).SetBytes(d)
+	priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(d)
+	return &Key{Priv: priv}, nil
+}
+
+// KnownClients is a ClientID -> public key allowlist loaded from disk on
+// server start; PipeHandShake and ServerHandShake refuse any client whose
+// proven ClientID isn't in it.
+type KnownClients map[crypto.UUID]*ecdsa.PublicKey
+
+// LoadKnownClients reads a known_clients file, one hex-encoded public key
+// per line (blank lines and lines starting with # are ignored).
+func LoadKnownClients(path string) (KnownClients, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open known_clients file")
+	}
+	defer f.Close()
+
+	known := make(KnownClients)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode known_clients entry %q", line)
+		}
+		x, y := elliptic.Unmarshal(curve, raw)
+		if x == nil {
+			return nil, errors.Errorf("invalid public key in known_clients entry %q", line)
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		known[PublicKeyToClientID(pub)] = pub
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "scan known_clients file")
+	}
+	return known, nil
+}
@@ -0,0 +1,177 @@
+// Package msg defines the control-channel wire protocol between server and
+// client: a MsgType tag, a length-prefixed gob-encoded body, and the request/
+// response structs carried over it.
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"net"
+	"time"
+
+	"Lunnel/crypto"
+
+	"github.com/pkg/errors"
+)
+
+// MsgType tags the body that follows it on the wire.
+type MsgType uint8
+
+const (
+	TypePing MsgType = iota
+	TypePong
+	TypePipeReq
+	TypeClientKeyExchange
+	TypeServerKeyExchange
+	TypeClientID
+	TypeSyncTunnels
+	// TypeAuthChallenge and TypeAuthResponse carry the node-identity
+	// handshake added alongside ClientID derivation: the server challenges
+	// the client with a nonce, and the client proves ownership of its
+	// long-lived key by signing it.
+	TypeAuthChallenge
+	TypeAuthResponse
+)
+
+// Tunnel describes one proxied tunnel a client asks the server to open.
+// Protocol selects which listener serveTCPTunnel/serveUDPTunnel binds; it's
+// treated as "tcp" when empty.
+type Tunnel struct {
+	Protocol      string
+	LocalAddress  string
+	RemoteAddress string
+}
+
+// SyncTunnels is exchanged once per control connection to agree on the set
+// of tunnels it carries.
+type SyncTunnels struct {
+	Tunnels []Tunnel
+}
+
+// CipherKeyExchange carries one side's half of a Diffie-Hellman-style key
+// exchange used to derive the control channel's preMasterSecret.
+type CipherKeyExchange struct {
+	CipherKey []byte
+}
+
+// ClientIDExchange tells the client the ClientID the server derived for it.
+type ClientIDExchange struct {
+	ClientID crypto.UUID
+}
+
+// AuthChallenge is the server-issued nonce a client must sign with its
+// long-lived node-identity key to prove it owns the key behind its ClientID.
+type AuthChallenge struct {
+	Nonce []byte
+}
+
+// AuthResponse answers an AuthChallenge with the client's raw marshalled
+// public key and its signature over the challenge nonce.
+type AuthResponse struct {
+	PublicKey []byte
+	Signature []byte
+}
+
+// PipeClientHello opens a new pipe (smux session) onto an existing control.
+// HMAC authenticates (ClientID, Once) under the control's preMasterSecret, so
+// a stolen ClientID alone can't be used to attach a pipe to someone else's
+// session pool. Under the plain transport preMasterSecret is empty, so the
+// HMAC does not authenticate there.
+type PipeClientHello struct {
+	ClientID crypto.UUID
+	Once     [16]byte
+	HMAC     []byte
+}
+
+// readTimeout bounds how long ReadMsg blocks waiting for a message; callers
+// that need to block indefinitely (e.g. the control's idle recvLoop) use
+// ReadMsgWithoutTimeout instead.
+const readTimeout = time.Second * 10
+
+// ReadMsg reads one message from conn, failing if none arrives within
+// readTimeout.
+func ReadMsg(conn net.Conn) (MsgType, interface{}, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+		return 0, nil, errors.Wrap(err, "SetReadDeadline")
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	return readMsg(conn)
+}
+
+// ReadMsgWithoutTimeout reads one message from r, blocking indefinitely.
+func ReadMsgWithoutTimeout(r io.Reader) (MsgType, interface{}, error) {
+	return readMsg(r)
+}
+
+func readMsg(r io.Reader) (MsgType, interface{}, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, errors.Wrap(err, "read message header")
+	}
+	mType := MsgType(header[0])
+	length := binary.BigEndian.Uint32(header[1:])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, errors.Wrap(err, "read message body")
+	}
+	body, err := decodeBody(mType, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	return mType, body, nil
+}
+
+// WriteMsg writes one length-prefixed, gob-encoded message to w. body may be
+// nil for message types that carry no payload (e.g. TypePing/TypePipeReq).
+func WriteMsg(w io.Writer, mType MsgType, body interface{}) error {
+	var payload []byte
+	if body != nil {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+			return errors.Wrap(err, "gob encode message body")
+		}
+		payload = buf.Bytes()
+	}
+	header := make([]byte, 5)
+	header[0] = byte(mType)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return errors.Wrap(err, "write message header")
+	}
+	if _, err := w.Write(payload); err != nil {
+		return errors.Wrap(err, "write message body")
+	}
+	return nil
+}
+
+// newBody returns the zero value to decode mType's payload into, or nil for
+// message types with no body.
+func newBody(mType MsgType) interface{} {
+	switch mType {
+	case TypeSyncTunnels:
+		return &SyncTunnels{}
+	case TypeClientKeyExchange, TypeServerKeyExchange:
+		return &CipherKeyExchange{}
+	case TypeClientID:
+		return &ClientIDExchange{}
+	case TypeAuthChallenge:
+		return &AuthChallenge{}
+	case TypeAuthResponse:
+		return &AuthResponse{}
+	default:
+		return nil
+	}
+}
+
+func decodeBody(mType MsgType, payload []byte) (interface{}, error) {
+	body := newBody(mType)
+	if body == nil {
+		return nil, nil
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(body); err != nil {
+		return nil, errors.Wrap(err, "gob decode message body")
+	}
+	return body, nil
+}
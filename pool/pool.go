@@ -0,0 +1,402 @@
+// Package pool implements a QoS-aware, prioritized session pool on top of
+// smux. It replaces the hand-rolled doubly-linked-list idle/busy pipe
+// bookkeeping that used to live in server.Control with a single
+// mutex-protected heap, so the least-loaded live session can always be
+// found in O(log n).
+package pool
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// Config bounds how a SessionPool grows, shrinks and rate limits the
+// sessions it manages.
+type Config struct {
+	// MinIdle is the number of idle (low-load) sessions the pool tries to
+	// keep on hand; callers are expected to ask the remote side for more
+	// pipes when NeedMore reports true.
+	MinIdle int
+	// MaxIdle is the number of fully idle sessions Clean always keeps; idle
+	// sessions beyond that count (in heap order, not by age) are closed once
+	// IdleTTL has passed.
+	MaxIdle int
+	// MaxStreams is the maximum number of concurrently open streams a
+	// single session is allowed to carry before it's considered busy.
+	MaxStreams int
+	// IdleTTL is how long since a session last opened a stream before Clean
+	// may close it, provided it has zero open streams.
+	IdleTTL time.Duration
+	// UpRateBytes/DownRateBytes cap per-session throughput, 0 disables.
+	UpRateBytes   int64
+	DownRateBytes int64
+	// StreamsPerSec caps how many new streams a session may open per
+	// second, 0 disables.
+	StreamsPerSec int
+}
+
+// DefaultConfig mirrors the previous hardcoded maxIdlePipes=3, maxStreams=6
+// behaviour, with rate limiting disabled.
+func DefaultConfig() Config {
+	return Config{
+		MinIdle:    1,
+		MaxIdle:    3,
+		MaxStreams: 6,
+		IdleTTL:    time.Minute,
+	}
+}
+
+// Stats is a point-in-time snapshot of a SessionPool, suitable for
+// exporting to a metrics backend.
+type Stats struct {
+	Sessions    int
+	IdleStreams int
+	BusyStreams int
+}
+
+// Pipe wraps a *smux.Session with its heap position and rate limiting
+// state: limiter paces new streams, upLimiter/downLimiter pace bytes
+// written/read on every stream opened from this pipe.
+type Pipe struct {
+	sess        *smux.Session
+	lastUse     time.Time
+	heapIndex   int
+	limiter     *tokenBucket
+	upLimiter   *tokenBucket
+	downLimiter *tokenBucket
+}
+
+// Session returns the underlying smux session.
+func (p *Pipe) Session() *smux.Session { return p.sess }
+
+// NumStreams reports the number of open streams on this pipe.
+func (p *Pipe) NumStreams() int { return p.sess.NumStreams() }
+
+// IsClosed reports whether the underlying session has been closed.
+func (p *Pipe) IsClosed() bool { return p.sess.IsClosed() }
+
+// OpenStream consumes a token from the pipe's rate limiter before opening a
+// new smux stream, so a session that's being throttled returns an error
+// instead of silently overloading the remote peer. The returned Stream
+// paces its Read/Write calls against the pipe's configured up/down byte
+// rate limits.
+func (p *Pipe) OpenStream(laddr string) (*Stream, error) {
+	if p.limiter != nil && !p.limiter.Allow() {
+		return nil, errors.New("pool: pipe stream rate limit exceeded")
+	}
+	stream, err := p.sess.OpenStream(laddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "smux.OpenStream")
+	}
+	p.lastUse = time.Now()
+	return &Stream{Stream: stream, up: p.upLimiter, down: p.downLimiter}, nil
+}
+
+// Close closes the underlying session.
+func (p *Pipe) Close() error { return p.sess.Close() }
+
+// Stream wraps a *smux.Stream to pace Read/Write against its pipe's
+// upload/download byte-rate limiters.
+type Stream struct {
+	*smux.Stream
+	up   *tokenBucket
+	down *tokenBucket
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if n > 0 && s.down != nil {
+		s.down.WaitN(n)
+	}
+	return n, err
+}
+
+func (s *Stream) Write(b []byte) (int, error) {
+	if s.up != nil {
+		s.up.WaitN(len(b))
+	}
+	return s.Stream.Write(b)
+}
+
+// pipeHeap orders Pipes by (open-stream count asc, last-use desc) as of
+// their last push or heap.Init, so its root is the least-loaded,
+// most-recently-used session at that time.
+type pipeHeap []*Pipe
+
+func (h pipeHeap) Len() int { return len(h) }
+func (h pipeHeap) Less(i, j int) bool {
+	si, sj := h[i].NumStreams(), h[j].NumStreams()
+	if si != sj {
+		return si < sj
+	}
+	return h[i].lastUse.After(h[j].lastUse)
+}
+func (h pipeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+func (h *pipeHeap) Push(x interface{}) {
+	p := x.(*Pipe)
+	p.heapIndex = len(*h)
+	*h = append(*h, p)
+}
+func (h *pipeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	p := old[n-1]
+	old[n-1] = nil
+	p.heapIndex = -1
+	*h = old[:n-1]
+	return p
+}
+
+// SessionPool is a mutex-protected, QoS-aware pool of smux sessions
+// belonging to a single client.
+type SessionPool struct {
+	cfg Config
+
+	mu     sync.Mutex
+	pipes  pipeHeap
+	closed bool
+
+	notifyMu sync.Mutex
+	notifyCh chan struct{}
+}
+
+// New creates a SessionPool governed by cfg.
+func New(cfg Config) *SessionPool {
+	return &SessionPool{
+		cfg:      cfg,
+		notifyCh: make(chan struct{}),
+	}
+}
+
+// Add registers a freshly dialed/accepted session with the pool.
+func (sp *SessionPool) Add(sess *smux.Session) {
+	p := &Pipe{sess: sess, lastUse: time.Now()}
+	if sp.cfg.StreamsPerSec > 0 {
+		p.limiter = newTokenBucket(sp.cfg.StreamsPerSec, sp.cfg.StreamsPerSec)
+	}
+	if sp.cfg.UpRateBytes > 0 {
+		p.upLimiter = newByteTokenBucket(sp.cfg.UpRateBytes)
+	}
+	if sp.cfg.DownRateBytes > 0 {
+		p.downLimiter = newByteTokenBucket(sp.cfg.DownRateBytes)
+	}
+	sp.mu.Lock()
+	if sp.closed {
+		sp.mu.Unlock()
+		sess.Close()
+		return
+	}
+	heap.Push(&sp.pipes, p)
+	sp.mu.Unlock()
+	sp.notify()
+}
+
+// Get pops the least-loaded live session out of the pool, skipping and
+// discarding any closed sessions it encounters. Because NumStreams() can
+// change while a Pipe sits in the heap (heap.Fix isn't called on every
+// stream open/close), the root popped off isn't guaranteed to be the least
+// loaded live Pipe any more, so a single busy pop doesn't mean every pipe is
+// busy: Get keeps scanning past busy pipes, restoring them to the heap
+// afterward, until it finds one under MaxStreams or exhausts the pool.
+// It returns nil only once every live pipe has been checked and found busy.
+func (sp *SessionPool) Get() *Pipe {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	var skipped []*Pipe
+	var found *Pipe
+	for sp.pipes.Len() > 0 {
+		p := heap.Pop(&sp.pipes).(*Pipe)
+		if p.IsClosed() {
+			continue
+		}
+		if p.NumStreams() >= sp.cfg.MaxStreams {
+			skipped = append(skipped, p)
+			continue
+		}
+		found = p
+		break
+	}
+	for _, p := range skipped {
+		heap.Push(&sp.pipes, p)
+	}
+	return found
+}
+
+// Put returns a session to the pool once the caller is done using it for
+// the moment (it may still carry open streams).
+func (sp *SessionPool) Put(p *Pipe) {
+	sp.mu.Lock()
+	if sp.closed || p.IsClosed() {
+		sp.mu.Unlock()
+		return
+	}
+	heap.Push(&sp.pipes, p)
+	sp.mu.Unlock()
+	sp.notify()
+}
+
+// Clean drops closed sessions and closes idle ones in excess of MaxIdle
+// that have sat unused past IdleTTL.
+func (sp *SessionPool) Clean() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	live := sp.pipes[:0]
+	idle := 0
+	for _, p := range sp.pipes {
+		if p.IsClosed() {
+			continue
+		}
+		if p.NumStreams() == 0 {
+			idle++
+			if idle > sp.cfg.MaxIdle && time.Since(p.lastUse) > sp.cfg.IdleTTL {
+				p.Close()
+				continue
+			}
+		}
+		live = append(live, p)
+	}
+	sp.pipes = live
+	heap.Init(&sp.pipes)
+}
+
+// NeedMore reports whether the pool has fewer idle sessions than
+// cfg.MinIdle and the caller should request another pipe from the peer.
+func (sp *SessionPool) NeedMore() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	idle := 0
+	for _, p := range sp.pipes {
+		if !p.IsClosed() && p.NumStreams() == 0 {
+			idle++
+		}
+	}
+	return idle < sp.cfg.MinIdle
+}
+
+// Notify returns a channel that's closed the next time a session is added
+// to or returned to the pool, for callers blocked waiting in Get.
+func (sp *SessionPool) Notify() <-chan struct{} {
+	sp.notifyMu.Lock()
+	defer sp.notifyMu.Unlock()
+	return sp.notifyCh
+}
+
+func (sp *SessionPool) notify() {
+	sp.notifyMu.Lock()
+	close(sp.notifyCh)
+	sp.notifyCh = make(chan struct{})
+	sp.notifyMu.Unlock()
+}
+
+// Stats reports a snapshot of the pool for observability.
+func (sp *SessionPool) Stats() Stats {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	var st Stats
+	st.Sessions = sp.pipes.Len()
+	for _, p := range sp.pipes {
+		if p.NumStreams() == 0 {
+			st.IdleStreams++
+		} else {
+			st.BusyStreams += p.NumStreams()
+		}
+	}
+	return st
+}
+
+// Close closes every session held by the pool and marks it closed so
+// further Add calls close the session instead of queuing it.
+func (sp *SessionPool) Close() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.closed = true
+	for _, p := range sp.pipes {
+		p.Close()
+	}
+	sp.pipes = nil
+}
+
+// tokenBucket is a minimal allocation-free token bucket used to rate limit
+// stream creation, and separately upload/download bytes, on a single
+// pooled pipe.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	max      float64
+	rate     float64
+	lastFill time.Time
+}
+
+func newTokenBucket(ratePerSec, burst int) *tokenBucket {
+	return &tokenBucket{
+		tokens:   float64(burst),
+		max:      float64(burst),
+		rate:     float64(ratePerSec),
+		lastFill: time.Now(),
+	}
+}
+
+// newByteTokenBucket builds a bucket sized for byte-rate limiting: its
+// burst equals one second's worth of the configured rate.
+func newByteTokenBucket(ratePerSec int64) *tokenBucket {
+	return &tokenBucket{
+		tokens:   float64(ratePerSec),
+		max:      float64(ratePerSec),
+		rate:     float64(ratePerSec),
+		lastFill: time.Now(),
+	}
+}
+
+func (tb *tokenBucket) refill() {
+	now := time.Now()
+	elapsed := now.Sub(tb.lastFill).Seconds()
+	tb.lastFill = now
+	tb.tokens += elapsed * tb.rate
+	if tb.tokens > tb.max {
+		tb.tokens = tb.max
+	}
+}
+
+// Allow consumes a single token if one is available.
+func (tb *tokenBucket) Allow() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill()
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// WaitN blocks until n tokens are available, then consumes them. It's used
+// to pace byte throughput rather than reject individual reads/writes. When
+// n exceeds the bucket's burst it waits for a full bucket and leaves the
+// bucket in debt, so later calls wait for the excess.
+func (tb *tokenBucket) WaitN(n int) {
+	need := float64(n)
+	if need > tb.max {
+		need = tb.max
+	}
+	for {
+		tb.mu.Lock()
+		tb.refill()
+		if tb.tokens >= need {
+			tb.tokens -= float64(n)
+			tb.mu.Unlock()
+			return
+		}
+		deficit := need - tb.tokens
+		wait := time.Duration(deficit / tb.rate * float64(time.Second))
+		tb.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
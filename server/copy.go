@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// copyBufSize matches the 32KB buffer io.Copy would otherwise allocate per
+// call; bufPool is package-level, so every tunnel connection's bufferedCopy
+// draws from it instead of allocating one per direction per connection.
+const copyBufSize = 32 * 1024
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufSize)
+		return &b
+	},
+}
+
+// bufferedCopy is a sync.Pool-backed stand-in for io.Copy that also feeds a
+// running byte counter, so callers can expose bytes_in/bytes_out metrics
+// without a second pass over the data.
+func bufferedCopy(dst io.Writer, src io.Reader, counter *uint64) (int64, error) {
+	bufp := bufPool.Get().(*[]byte)
+	defer bufPool.Put(bufp)
+	buf := *bufp
+
+	var written int64
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[:nr])
+			if nw > 0 {
+				written += int64(nw)
+				if counter != nil {
+					atomic.AddUint64(counter, uint64(nw))
+				}
+			}
+			if ew != nil {
+				return written, ew
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er != nil {
+			if er == io.EOF {
+				er = nil
+			}
+			return written, er
+		}
+	}
+}
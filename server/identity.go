@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"sync"
+
+	"Lunnel/identity"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+var knownClientsLock sync.RWMutex
+var knownClients identity.KnownClients
+
+// allowUnknownClients opts out of allowlist enforcement entirely; it must be
+// set explicitly via AllowUnknownClients, since the safe default is to
+// reject every client until LoadKnownClients has been called.
+var allowUnknownClients bool
+
+// LoadKnownClients loads the known_clients allowlist from path; call this
+// once on server start, before accepting any control connections.
+func LoadKnownClients(path string) error {
+	known, err := identity.LoadKnownClients(path)
+	if err != nil {
+		return errors.Wrap(err, "identity.LoadKnownClients")
+	}
+	knownClientsLock.Lock()
+	knownClients = known
+	knownClientsLock.Unlock()
+	log.WithFields(log.Fields{"count": len(known)}).Infoln("loaded known_clients allowlist")
+	return nil
+}
+
+// AllowUnknownClients disables allowlist enforcement, accepting any
+// self-generated client keypair. It exists for development/testing only;
+// call it explicitly, never as a fallback, and expect it to be logged
+// loudly every time a client connects under it.
+func AllowUnknownClients() {
+	allowUnknownClients = true
+	log.Warningln("known_clients allowlist enforcement disabled: accepting any client keypair")
+}
+
+// authorizedPublicKey looks up pub's corresponding allowlist entry by the
+// ClientID it derives to; it returns an error if that key isn't allowlisted.
+// With no allowlist loaded and AllowUnknownClients not called, every client
+// is rejected: failing open here would silently defeat the entire point of
+// node-identity verification.
+func authorizedPublicKey(pub *ecdsa.PublicKey) (*ecdsa.PublicKey, error) {
+	knownClientsLock.RLock()
+	defer knownClientsLock.RUnlock()
+	if knownClients == nil {
+		if allowUnknownClients {
+			log.Warningln("accepting client with unverified public key: known_clients allowlist is not loaded")
+			return pub, nil
+		}
+		return nil, errors.New("no known_clients allowlist loaded: rejecting client (call LoadKnownClients or AllowUnknownClients)")
+	}
+	allowed, ok := knownClients[identity.PublicKeyToClientID(pub)]
+	if !ok {
+		return nil, errors.New("client public key is not in known_clients allowlist")
+	}
+	return allowed, nil
+}
+
+func newServerNonce() ([]byte, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "rand.Read nonce")
+	}
+	return nonce, nil
+}
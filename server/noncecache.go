@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"Lunnel/crypto"
+)
+
+// nonceCacheSize bounds the ring buffer to the last N (ClientID, Once)
+// pairs seen, per Control.
+const nonceCacheSize = 1024
+
+// nonceWindow additionally bounds how long a nonce is remembered, so a
+// long-lived control doesn't have to distinguish "slot recycled" from
+// "legitimately reused after a long time" - anything older than the window
+// is treated as not-seen even if its slot hasn't been recycled yet.
+const nonceWindow = time.Minute * 5
+
+// clientIDSize matches crypto.UUID's length.
+const clientIDSize = 16
+
+// nonceKey is the fixed-size, allocation-free combination of a ClientID and
+// an Once value used as the ring buffer's lookup key.
+type nonceKey [clientIDSize * 2]byte
+
+func makeNonceKey(clientID crypto.UUID, once []byte) nonceKey {
+	var k nonceKey
+	copy(k[:clientIDSize], clientID[:])
+	copy(k[clientIDSize:], once)
+	return k
+}
+
+type nonceEntry struct {
+	key    nonceKey
+	seenAt time.Time
+}
+
+// nonceCache is a constant-time-lookup, allocation-free-on-the-hot-path
+// replay cache: a fixed ring buffer of the last nonceCacheSize nonces, with
+// a map from key to ring slot for O(1) lookup. Safe for concurrent use.
+type nonceCache struct {
+	mu      sync.Mutex
+	entries [nonceCacheSize]nonceEntry
+	index   map[nonceKey]int
+	next    int
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{index: make(map[nonceKey]int, nonceCacheSize)}
+}
+
+// CheckAndStore reports whether (clientID, once) has already been seen
+// within nonceWindow. A fresh pair is recorded under the same lock as the
+// lookup, so a racing pair of identical requests can't both pass; a replayed
+// pair is rejected without refreshing its record.
+func (nc *nonceCache) CheckAndStore(clientID crypto.UUID, once []byte) (fresh bool) {
+	key := makeNonceKey(clientID, once)
+	now := time.Now()
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	if slot, ok := nc.index[key]; ok {
+		if now.Sub(nc.entries[slot].seenAt) < nonceWindow {
+			return false
+		}
+	}
+
+	slot := nc.next
+	evicted := nc.entries[slot]
+	// A key re-stored after its window expired has a newer slot; only drop
+	// the index entry if it still points at the slot being recycled.
+	if evicted.key != (nonceKey{}) && nc.index[evicted.key] == slot {
+		delete(nc.index, evicted.key)
+	}
+	nc.entries[slot] = nonceEntry{key: key, seenAt: now}
+	nc.index[key] = slot
+	nc.next = (nc.next + 1) % nonceCacheSize
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"Lunnel/crypto"
+)
+
+func TestNonceCacheRejectsReplay(t *testing.T) {
+	nc := newNonceCache()
+	var clientID crypto.UUID
+	once := []byte("0123456789abcdef")
+
+	if !nc.CheckAndStore(clientID, once) {
+		t.Fatal("first use of a nonce should be fresh")
+	}
+	if nc.CheckAndStore(clientID, once) {
+		t.Fatal("replayed nonce should be rejected")
+	}
+}
+
+func TestNonceCacheDistinctNonces(t *testing.T) {
+	nc := newNonceCache()
+	var clientID crypto.UUID
+
+	for i := 0; i < 10; i++ {
+		once := []byte{byte(i)}
+		if !nc.CheckAndStore(clientID, once) {
+			t.Fatalf("nonce %d should be fresh", i)
+		}
+	}
+}
+
+func TestNonceCacheEvictsOldest(t *testing.T) {
+	nc := newNonceCache()
+	var clientID crypto.UUID
+
+	first := []byte("first-nonce")
+	if !nc.CheckAndStore(clientID, first) {
+		t.Fatal("first nonce should be fresh")
+	}
+	for i := 0; i < nonceCacheSize; i++ {
+		nc.CheckAndStore(clientID, []byte{byte(i), byte(i >> 8)})
+	}
+	if !nc.CheckAndStore(clientID, first) {
+		t.Fatal("nonce evicted from the ring buffer should be treated as fresh again")
+	}
+}
+
+func TestNonceCacheConcurrentUseIsRaceFree(t *testing.T) {
+	nc := newNonceCache()
+	var clientID crypto.UUID
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	passed := 0
+
+	const attempts = 200
+	for i := 0; i < attempts; i++ {
+		wg.Add(2)
+		once := []byte{byte(i), byte(i >> 8)}
+		for j := 0; j < 2; j++ {
+			go func() {
+				defer wg.Done()
+				if nc.CheckAndStore(clientID, once) {
+					mu.Lock()
+					passed++
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	if passed != attempts {
+		t.Fatalf("expected exactly one winner per nonce, got %d passes for %d nonces", passed, attempts)
+	}
+}
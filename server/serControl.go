@@ -2,7 +2,14 @@ package main
 
 import (
 	"Lunnel/crypto"
+	"Lunnel/identity"
 	"Lunnel/msg"
+	"Lunnel/pool"
+	"Lunnel/transport"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"net"
@@ -15,9 +22,6 @@ import (
 	"github.com/xtaci/smux"
 )
 
-var maxIdlePipes int = 3
-var maxStreams int = 6
-
 var pingInterval time.Duration = time.Second * 8
 var pingTimeout time.Duration = time.Second * 15
 var cleanInterval time.Duration = time.Second * 5
@@ -25,15 +29,14 @@ var cleanInterval time.Duration = time.Second * 5
 var ControlMapLock sync.RWMutex
 var ControlMap = make(map[crypto.UUID]*Control)
 
-func NewControl(conn net.Conn, encryptMode string) *Control {
+func NewControl(conn net.Conn) *Control {
 	ctl := &Control{
-		ctlConn:     conn,
-		pipeGet:     make(chan *smux.Session),
-		pipeAdd:     make(chan *smux.Session),
-		die:         make(chan struct{}),
-		toDie:       make(chan struct{}),
-		writeChan:   make(chan writeReq, 128),
-		encryptMode: encryptMode,
+		ctlConn:   conn,
+		pipes:     pool.New(pool.DefaultConfig()),
+		nonces:    newNonceCache(),
+		die:       make(chan struct{}),
+		toDie:     make(chan struct{}),
+		writeChan: make(chan writeReq, 128),
 	}
 
 	return ctl
@@ -46,13 +49,7 @@ type writeReq struct {
 
 type Tunnel struct {
 	tunnelInfo msg.Tunnel
-	listener   net.Listener
-}
-
-type pipeNode struct {
-	prev *pipeNode
-	next *pipeNode
-	pipe *smux.Session
+	closer     io.Closer
 }
 
 type Control struct {
@@ -60,196 +57,85 @@ type Control struct {
 	tunnels         []Tunnel
 	preMasterSecret []byte
 	lastRead        uint64
-	encryptMode     string
+	transport       transport.Transport
 
-	busyPipes *pipeNode
-	idleCount int
-	idlePipes *pipeNode
-	pipeAdd   chan *smux.Session
-	pipeGet   chan *smux.Session
+	pipes  *pool.SessionPool
+	nonces *nonceCache
 
 	die       chan struct{}
 	toDie     chan struct{}
 	writeChan chan writeReq
 
 	ClientID crypto.UUID
-}
-
-func (c *Control) addIdlePipe(pipe *smux.Session) {
-	pNode := &pipeNode{pipe: pipe, prev: nil, next: nil}
-	if c.idlePipes != nil {
-		c.idlePipes.prev = pNode
-		pNode.next = c.idlePipes
-	}
-	c.idlePipes = pNode
-	c.idleCount++
-
-}
 
-func (c *Control) addBusyPipe(pipe *smux.Session) {
-	pNode := &pipeNode{pipe: pipe, prev: nil, next: nil}
-	if c.busyPipes != nil {
-		c.busyPipes.prev = pNode
-		pNode.next = c.busyPipes
-	}
-	c.busyPipes = pNode
+	// bytesIn/bytesOut/activeStreams are Prometheus-style counters/gauges
+	// for the data plane, updated by the TCP and UDP tunnel forwarding code.
+	bytesIn       uint64
+	bytesOut      uint64
+	activeStreams int64
 }
 
-func (c *Control) removeIdleNode(pNode *pipeNode) {
-	if pNode.prev == nil {
-		c.idlePipes = pNode.next
-		if c.idlePipes != nil {
-			c.idlePipes.prev = nil
-		}
-	} else {
-		pNode.prev.next = pNode.next
-		if pNode.next != nil {
-			pNode.next.prev = pNode.prev
-		}
-	}
-	c.idleCount--
+// Metrics is a point-in-time snapshot of a Control's data-plane counters.
+type Metrics struct {
+	BytesIn       uint64
+	BytesOut      uint64
+	ActiveStreams int64
 }
 
-func (c *Control) removeBusyNode(pNode *pipeNode) {
-	if pNode.prev == nil {
-		c.busyPipes = pNode.next
-		if c.busyPipes != nil {
-			c.busyPipes.prev = nil
-		}
-	} else {
-		pNode.prev.next = pNode.next
-		if pNode.next != nil {
-			pNode.next.prev = pNode.prev
-		}
+// Metrics reports the current bytes_in/bytes_out/active_streams counters
+// for this control's tunnels.
+func (c *Control) Metrics() Metrics {
+	return Metrics{
+		BytesIn:       atomic.LoadUint64(&c.bytesIn),
+		BytesOut:      atomic.LoadUint64(&c.bytesOut),
+		ActiveStreams: atomic.LoadInt64(&c.activeStreams),
 	}
 }
 
 func (c *Control) putPipe(p *smux.Session) {
-	select {
-	case c.pipeAdd <- p:
-	case <-c.die:
-		p.Close()
-		return
-	}
-	return
-}
-
-func (c *Control) getPipe() *smux.Session {
-	select {
-	case p := <-c.pipeGet:
-		return p
-	case <-c.die:
-		return nil
-	}
+	c.pipes.Add(p)
 }
 
-func (c *Control) clean() {
-	busy := c.busyPipes
-	for {
-		if busy == nil {
-			break
-		}
-		if busy.pipe.IsClosed() {
-			c.removeBusyNode(busy)
-		} else if busy.pipe.NumStreams() < maxStreams {
-			c.removeBusyNode(busy)
-			c.addIdlePipe(busy.pipe)
-		}
-		busy = busy.next
-	}
-	idle := c.idlePipes
+// getPipe returns the least-loaded live pipe, requesting a new one from the
+// client via writeChan when the pool is empty.
+func (c *Control) getPipe() *pool.Pipe {
 	for {
-		if idle == nil {
-			return
+		if c.IsClosed() {
+			return nil
 		}
-		if idle.pipe.IsClosed() {
-			c.removeIdleNode(idle)
-		} else if idle.pipe.NumStreams() == 0 && c.idleCount > maxIdlePipes {
-			log.WithFields(log.Fields{"time": time.Now().Unix(), "pipe": fmt.Sprintf("%p", idle.pipe)}).Infoln("remove and close idle")
-			c.removeIdleNode(idle)
-			idle.pipe.Close()
+		if p := c.pipes.Get(); p != nil {
+			return p
 		}
-		idle = idle.next
-	}
-	return
-
-}
-func (c *Control) getIdleFast() (idle *pipeNode) {
-	idle = c.idlePipes
-	for {
-		if idle == nil {
-			return
+		select {
+		case c.writeChan <- writeReq{msg.TypePipeReq, nil}:
+		case <-c.die:
+			return nil
 		}
-		if idle.pipe.IsClosed() {
-			c.removeIdleNode(idle)
-			idle = idle.next
-		} else {
-			c.removeIdleNode(idle)
-			return
+		select {
+		case <-c.pipes.Notify():
+		case <-time.After(time.Second * 12):
+			return nil
+		case <-c.die:
+			return nil
 		}
 	}
-	return
 }
 
+// pipeManage periodically cleans the session pool and asks the client for
+// more pipes whenever the idle count falls below its configured minimum.
 func (c *Control) pipeManage() {
-	var available *smux.Session
 	ticker := time.NewTicker(cleanInterval)
 	defer ticker.Stop()
 	for {
-	Prepare:
-		if available == nil || available.IsClosed() {
-			available = nil
-			idle := c.getIdleFast()
-			if idle == nil {
-				c.clean()
-				idle := c.getIdleFast()
-				c.writeChan <- writeReq{msg.TypePipeReq, nil}
-				if idle == nil {
-					pipeGetTimeout := time.After(time.Second * 12)
-					for {
-						select {
-						case <-ticker.C:
-							c.clean()
-							idle := c.getIdleFast()
-							if idle != nil {
-								available = idle.pipe
-								goto Available
-							}
-						case p := <-c.pipeAdd:
-							if !p.IsClosed() {
-								if p.NumStreams() < maxStreams {
-									available = p
-									goto Available
-								} else {
-									c.addBusyPipe(p)
-								}
-							}
-						case <-c.die:
-							return
-						case <-pipeGetTimeout:
-							goto Prepare
-						}
-					}
-				} else {
-					available = idle.pipe
-				}
-			} else {
-				available = idle.pipe
-			}
-		}
-	Available:
 		select {
 		case <-ticker.C:
-			c.clean()
-		case c.pipeGet <- available:
-			log.WithFields(log.Fields{"pipe": fmt.Sprintf("%p", available)}).Infoln("dispatch pipe to consumer")
-			available = nil
-		case p := <-c.pipeAdd:
-			if !p.IsClosed() {
-				if p.NumStreams() < maxStreams {
-					c.addIdlePipe(p)
-				} else {
-					c.addBusyPipe(p)
+			c.pipes.Clean()
+			if c.pipes.NeedMore() {
+				select {
+				case c.writeChan <- writeReq{msg.TypePipeReq, nil}:
+				case <-c.die:
+					return
+				default:
 				}
 			}
 		case <-c.die:
@@ -281,28 +167,9 @@ func (c *Control) moderator() {
 	log.WithFields(log.Fields{"ClientId": c.ClientID}).Infoln("client going to close")
 	close(c.die)
 	for _, t := range c.tunnels {
-		t.listener.Close()
-	}
-	idle := c.idlePipes
-	for {
-		if idle == nil {
-			break
-		}
-		if !idle.pipe.IsClosed() {
-			idle.pipe.Close()
-		}
-		idle = idle.next
-	}
-	busy := c.busyPipes
-	for {
-		if busy == nil {
-			break
-		}
-		if !busy.pipe.IsClosed() {
-			busy.pipe.Close()
-		}
-		busy = busy.next
+		t.closer.Close()
 	}
+	c.pipes.Close()
 	c.ctlConn.Close()
 }
 
@@ -387,61 +254,82 @@ func (c *Control) Serve() {
 
 }
 
-func (c *Control) ServerSyncTunnels(serverDomain string) error {
-	_, body, err := msg.ReadMsg(c.ctlConn)
+// serveTCPTunnel binds a TCP listener and, for every accepted connection,
+// pipes it through an smux stream taken from the pool.
+func (c *Control) serveTCPTunnel(t *msg.Tunnel) (io.Closer, int, error) {
+	lis, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: 0})
 	if err != nil {
-		return errors.Wrap(err, "ReadMsg sstm")
+		return nil, 0, errors.Wrap(err, "net.ListenTCP")
 	}
-	sstm := body.(*msg.SyncTunnels)
-	for i := range sstm.Tunnels {
-		t := &sstm.Tunnels[i]
-		lis, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: 0})
-		if err != nil {
-			return errors.Wrap(err, "binding TCP listener")
-		}
-		go func() {
-			for {
-				if c.IsClosed() {
+	go func() {
+		for {
+			if c.IsClosed() {
+				return
+			}
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				p := c.getPipe()
+				if p == nil {
 					return
 				}
-				conn, err := lis.Accept()
+				stream, err := p.OpenStream(t.LocalAddress)
 				if err != nil {
+					c.pipes.Put(p)
 					return
 				}
+				defer stream.Close()
+				c.pipes.Put(p)
+				atomic.AddInt64(&c.activeStreams, 1)
+				defer atomic.AddInt64(&c.activeStreams, -1)
+				p1die := make(chan struct{})
+				p2die := make(chan struct{})
 				go func() {
-					defer conn.Close()
-					p := c.getPipe()
-					if p == nil {
-						return
-					}
-					stream, err := p.OpenStream(t.LocalAddress)
-					if err != nil {
-						c.putPipe(p)
-						return
-					}
-					defer stream.Close()
-					c.putPipe(p)
-					p1die := make(chan struct{})
-					p2die := make(chan struct{})
-					go func() {
-						io.Copy(stream, conn)
-						close(p1die)
-					}()
-					go func() {
-						io.Copy(conn, stream)
-						close(p2die)
-					}()
-					select {
-					case <-p1die:
-					case <-p2die:
-					}
-					return
+					bufferedCopy(stream, conn, &c.bytesOut)
+					close(p1die)
+				}()
+				go func() {
+					bufferedCopy(conn, stream, &c.bytesIn)
+					close(p2die)
 				}()
+				select {
+				case <-p1die:
+				case <-p2die:
+				}
+				return
+			}()
+		}
+	}()
+	return lis, lis.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (c *Control) ServerSyncTunnels(serverDomain string) error {
+	_, body, err := msg.ReadMsg(c.ctlConn)
+	if err != nil {
+		return errors.Wrap(err, "ReadMsg sstm")
+	}
+	sstm := body.(*msg.SyncTunnels)
+	for i := range sstm.Tunnels {
+		t := &sstm.Tunnels[i]
+		var closer io.Closer
+		var port int
+		switch t.Protocol {
+		case "udp":
+			closer, port, err = c.serveUDPTunnel(t)
+			if err != nil {
+				return errors.Wrap(err, "binding UDP listener")
+			}
+		default:
+			closer, port, err = c.serveTCPTunnel(t)
+			if err != nil {
+				return errors.Wrap(err, "binding TCP listener")
 			}
-		}()
-		addr := lis.Addr().(*net.TCPAddr)
-		t.RemoteAddress = fmt.Sprintf("%s:%d", serverDomain, addr.Port)
-		c.tunnels = append(c.tunnels, Tunnel{*t, lis})
+		}
+		t.RemoteAddress = fmt.Sprintf("%s:%d", serverDomain, port)
+		c.tunnels = append(c.tunnels, Tunnel{*t, closer})
 	}
 	err = msg.WriteMsg(c.ctlConn, msg.TypeSyncTunnels, *sstm)
 	if err != nil {
@@ -450,13 +338,15 @@ func (c *Control) ServerSyncTunnels(serverDomain string) error {
 	return nil
 }
 
-func (c *Control) GenerateClientId() crypto.UUID {
-	c.ClientID = crypto.GenUUID()
-	return c.ClientID
-}
-
 func (c *Control) ServerHandShake() error {
-	if c.encryptMode != "none" {
+	wrapped, tr, err := transport.Dispatch(c.ctlConn)
+	if err != nil {
+		return errors.Wrap(err, "transport.Dispatch")
+	}
+	c.ctlConn = wrapped
+	c.transport = tr
+
+	if c.transport.Name() != "plain" {
 		mType, body, err := msg.ReadMsg(c.ctlConn)
 		if err != nil {
 			return errors.Wrap(err, "msg.ReadMsg")
@@ -482,9 +372,15 @@ func (c *Control) ServerHandShake() error {
 		}
 	}
 
+	pub, err := c.verifyClientIdentity()
+	if err != nil {
+		return errors.Wrap(err, "verifyClientIdentity")
+	}
+	c.ClientID = identity.PublicKeyToClientID(pub)
+
 	var cidm msg.ClientIDExchange
-	cidm.ClientID = c.GenerateClientId()
-	err := msg.WriteMsg(c.ctlConn, msg.TypeClientID, cidm)
+	cidm.ClientID = c.ClientID
+	err = msg.WriteMsg(c.ctlConn, msg.TypeClientID, cidm)
 	if err != nil {
 		return errors.Wrap(err, "Write ClientId")
 	}
@@ -494,24 +390,78 @@ func (c *Control) ServerHandShake() error {
 	return nil
 }
 
+// verifyClientIdentity issues a nonce challenge and checks the client's
+// signature over it with its long-lived node-identity key, rejecting any
+// client whose key isn't in the known_clients allowlist. This replaces the
+// previous anonymous, server-assigned random ClientID.
+func (c *Control) verifyClientIdentity() (*ecdsa.PublicKey, error) {
+	nonce, err := newServerNonce()
+	if err != nil {
+		return nil, err
+	}
+	err = msg.WriteMsg(c.ctlConn, msg.TypeAuthChallenge, msg.AuthChallenge{Nonce: nonce})
+	if err != nil {
+		return nil, errors.Wrap(err, "write AuthChallenge")
+	}
+	mType, body, err := msg.ReadMsg(c.ctlConn)
+	if err != nil {
+		return nil, errors.Wrap(err, "read AuthResponse")
+	}
+	if mType != msg.TypeAuthResponse {
+		return nil, errors.Errorf("invalid msg type(%d),expect(%d)", mType, msg.TypeAuthResponse)
+	}
+	resp := body.(*msg.AuthResponse)
+	x, y := elliptic.Unmarshal(elliptic.P256(), resp.PublicKey)
+	if x == nil {
+		return nil, errors.New("invalid client public key")
+	}
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	if !identity.Verify(pub, nonce, resp.Signature) {
+		return nil, errors.New("invalid nonce signature")
+	}
+	return authorizedPublicKey(pub)
+}
+
+// pipeHMAC computes the per-pipe authentication tag over (ClientID, Once),
+// keyed by the control's preMasterSecret, so a stolen ClientID alone isn't
+// enough to attach a connection to someone else's pipe pool. Under the plain
+// transport no key exchange takes place, preMasterSecret is empty, and the
+// tag can be computed from the ClientID and Once alone.
+func pipeHMAC(preMasterSecret []byte, clientID crypto.UUID, once []byte) []byte {
+	mac := hmac.New(sha256.New, preMasterSecret)
+	mac.Write(clientID[:])
+	mac.Write(once)
+	return mac.Sum(nil)
+}
+
 func PipeHandShake(conn net.Conn, phs *msg.PipeClientHello) error {
 	ControlMapLock.RLock()
 	ctl := ControlMap[phs.ClientID]
 	ControlMapLock.RUnlock()
+	if ctl == nil {
+		return errors.New("PipeHandShake: unknown ClientID")
+	}
+	expected := pipeHMAC(ctl.preMasterSecret, phs.ClientID, phs.Once[:])
+	if !hmac.Equal(expected, phs.HMAC) {
+		return errors.New("PipeHandShake: invalid pipe HMAC")
+	}
+	if !ctl.nonces.CheckAndStore(phs.ClientID, phs.Once[:]) {
+		return errors.New("PipeHandShake: replayed pipe nonce")
+	}
 	smuxConfig := smux.DefaultConfig()
 	smuxConfig.MaxReceiveBuffer = 4194304
 	var err error
 	var sess *smux.Session
-	if ctl.encryptMode != "none" {
+	if ctl.transport.Name() != "plain" {
 		prf := crypto.NewPrf12()
 		var masterKey []byte = make([]byte, 16)
 		prf(masterKey, ctl.preMasterSecret, phs.ClientID[:], phs.Once[:])
-		cryptoConn, err := crypto.NewCryptoConn(conn, masterKey)
+		wrapped, err := ctl.transport.Wrap(conn, masterKey)
 		if err != nil {
-			return errors.Wrap(err, "crypto.NewCryptoConn")
+			return errors.Wrap(err, "transport.Wrap")
 		}
 		//server endpoint is the pipe connection source,so we use smux.Client
-		sess, err = smux.Client(cryptoConn, smuxConfig)
+		sess, err = smux.Client(wrapped, smuxConfig)
 		if err != nil {
 			return errors.Wrap(err, "smux.Client")
 		}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"Lunnel/msg"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"Lunnel/pool"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// udpFlowIdleTimeout is how long a UDP flow can go without a datagram in
+// either direction before it's garbage collected, mirroring cleanInterval's
+// role for the pipe pool.
+var udpFlowIdleTimeout time.Duration = time.Minute * 2
+
+// udpFlow tracks a single UDP "connection", identified by its source
+// address, multiplexed onto one smux stream. stream is nil until ready is
+// closed, which happens once the pipe/stream setup done by setupUDPFlow
+// completes (successfully or not); a nil stream after ready is closed means
+// setup failed and the flow has already been removed from the flows map.
+type udpFlow struct {
+	raddr      *net.UDPAddr
+	stream     *pool.Stream
+	ready      chan struct{}
+	lastActive int64
+}
+
+// serveUDPTunnel binds a UDP socket and demuxes incoming datagrams into
+// per-source-address smux streams, framing each datagram with a 2-byte
+// length prefix so the client side can split the stream back into
+// datagrams.
+//
+// This is the server side only. Nothing in this tree turns a stream's
+// length-prefixed frames back into UDP datagrams for a local service on the
+// client side.
+func (c *Control) serveUDPTunnel(t *msg.Tunnel) (io.Closer, int, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: 0})
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "net.ListenUDP")
+	}
+
+	var mu sync.Mutex
+	flows := make(map[string]*udpFlow)
+
+	go func() {
+		ticker := time.NewTicker(cleanInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				now := time.Now().UnixNano()
+				mu.Lock()
+				for k, f := range flows {
+					if f.stream != nil && now-atomic.LoadInt64(&f.lastActive) > udpFlowIdleTimeout.Nanoseconds() {
+						f.stream.Close()
+						delete(flows, k)
+					}
+				}
+				mu.Unlock()
+			case <-c.die:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	go func() {
+		defer conn.Close()
+		for {
+			if c.IsClosed() {
+				return
+			}
+			n, raddr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			datagram := make([]byte, n)
+			copy(datagram, buf[:n])
+
+			mu.Lock()
+			f, ok := flows[raddr.String()]
+			if !ok {
+				f = &udpFlow{raddr: raddr, ready: make(chan struct{})}
+				flows[raddr.String()] = f
+			}
+			mu.Unlock()
+			if !ok {
+				// getPipe() can block for up to 12s when the pool is
+				// exhausted; running it inline here would stall this read
+				// loop, and therefore every UDP flow on this tunnel, not
+				// just the new one. Do setup off to the side and let
+				// sendToFlow wait on f.ready instead.
+				go c.setupUDPFlow(t, conn, f, &mu, flows, raddr.String())
+			}
+			atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+			sendToFlow(c, f, &mu, flows, raddr.String(), datagram)
+		}
+	}()
+
+	return conn, conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// setupUDPFlow takes a pipe from the pool and opens f's stream on it, then
+// starts the goroutine that demuxes the stream's reverse direction back onto
+// the UDP socket. It closes f.ready when done, leaving f.stream nil and the
+// flow removed from flows on failure.
+func (c *Control) setupUDPFlow(t *msg.Tunnel, conn *net.UDPConn, f *udpFlow, mu *sync.Mutex, flows map[string]*udpFlow, key string) {
+	defer close(f.ready)
+	p := c.getPipe()
+	if p == nil {
+		mu.Lock()
+		delete(flows, key)
+		mu.Unlock()
+		return
+	}
+	stream, err := p.OpenStream(t.LocalAddress)
+	c.pipes.Put(p)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warningln("open udp stream failed")
+		mu.Lock()
+		delete(flows, key)
+		mu.Unlock()
+		return
+	}
+	f.stream = stream
+	atomic.AddInt64(&c.activeStreams, 1)
+	go udpStreamToSocket(c, conn, f, mu, flows, key)
+}
+
+// sendToFlow writes datagram to f's stream once it's ready, without blocking
+// the caller: if the stream is already open it writes inline (the common
+// case, once a flow is established), otherwise it waits in its own
+// goroutine so the UDP read loop can keep demuxing other flows.
+func sendToFlow(c *Control, f *udpFlow, mu *sync.Mutex, flows map[string]*udpFlow, key string, datagram []byte) {
+	select {
+	case <-f.ready:
+		writeToFlow(c, f, mu, flows, key, datagram)
+	default:
+		go func() {
+			<-f.ready
+			writeToFlow(c, f, mu, flows, key, datagram)
+		}()
+	}
+}
+
+func writeToFlow(c *Control, f *udpFlow, mu *sync.Mutex, flows map[string]*udpFlow, key string, datagram []byte) {
+	if f.stream == nil {
+		return // setup failed; flow has already been removed from flows
+	}
+	if err := writeUDPFrame(f.stream, datagram); err != nil {
+		mu.Lock()
+		delete(flows, key)
+		mu.Unlock()
+		f.stream.Close()
+		return
+	}
+	atomic.AddUint64(&c.bytesIn, uint64(len(datagram)))
+}
+
+// udpStreamToSocket reads length-prefixed datagrams off a flow's smux
+// stream and writes them back to the originating UDP source address.
+func udpStreamToSocket(c *Control, conn *net.UDPConn, f *udpFlow, mu *sync.Mutex, flows map[string]*udpFlow, key string) {
+	defer func() {
+		mu.Lock()
+		delete(flows, key)
+		mu.Unlock()
+		f.stream.Close()
+		atomic.AddInt64(&c.activeStreams, -1)
+	}()
+	for {
+		datagram, err := readUDPFrame(f.stream)
+		if err != nil {
+			return
+		}
+		atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+		if _, err := conn.WriteToUDP(datagram, f.raddr); err != nil {
+			return
+		}
+		atomic.AddUint64(&c.bytesOut, uint64(len(datagram)))
+	}
+}
+
+// writeUDPFrame writes a single datagram to stream, length-prefixed with a
+// big-endian uint16.
+func writeUDPFrame(stream *pool.Stream, datagram []byte) error {
+	var header [2]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(datagram)))
+	if _, err := stream.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := stream.Write(datagram)
+	return err
+}
+
+// readUDPFrame reads a single length-prefixed datagram from stream.
+func readUDPFrame(stream *pool.Stream) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		return nil, err
+	}
+	datagram := make([]byte, binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(stream, datagram); err != nil {
+		return nil, err
+	}
+	return datagram, nil
+}
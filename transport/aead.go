@@ -0,0 +1,30 @@
+package transport
+
+import (
+	"net"
+
+	"Lunnel/crypto"
+
+	"github.com/pkg/errors"
+)
+
+// AEAD is the existing AEAD-wrapped TCP transport, previously hardcoded
+// into PipeHandShake as crypto.NewCryptoConn.
+type AEAD struct{}
+
+func (AEAD) Name() string { return "aead" }
+
+func (AEAD) Dial(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }
+
+func (AEAD) Listen(addr string) (net.Listener, error) { return net.Listen("tcp", addr) }
+
+func (AEAD) Wrap(conn net.Conn, key []byte) (net.Conn, error) {
+	if len(key) == 0 {
+		return conn, nil
+	}
+	wrapped, err := crypto.NewCryptoConn(conn, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "crypto.NewCryptoConn")
+	}
+	return wrapped, nil
+}
@@ -0,0 +1,15 @@
+package transport
+
+import "net"
+
+// Plain is the identity transport: no framing, no obfuscation, just the
+// raw TCP connection.
+type Plain struct{}
+
+func (Plain) Name() string { return "plain" }
+
+func (Plain) Dial(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }
+
+func (Plain) Listen(addr string) (net.Listener, error) { return net.Listen("tcp", addr) }
+
+func (Plain) Wrap(conn net.Conn, key []byte) (net.Conn, error) { return conn, nil }
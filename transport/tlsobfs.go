@@ -0,0 +1,182 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"Lunnel/crypto"
+
+	"github.com/pkg/errors"
+)
+
+// TLSObfs mimics a TLS 1.2 handshake (ClientHello/ServerHello/
+// ChangeCipherSpec/Finished) so pipe traffic is indistinguishable from
+// HTTPS on the wire, then frames application data as TLS application-data
+// records. The record framing alone is only obfuscation, not encryption;
+// whenever Wrap is given a non-nil key it layers AEAD.Wrap underneath the
+// framing so the record payloads themselves are encrypted too.
+type TLSObfs struct{}
+
+func (TLSObfs) Name() string { return "tlsobfs" }
+
+func (TLSObfs) Dial(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }
+
+func (TLSObfs) Listen(addr string) (net.Listener, error) { return net.Listen("tcp", addr) }
+
+// Wrap performs the server side of the fake handshake and returns a conn
+// that frames Read/Write in TLS application-data records, with those
+// records themselves AEAD-encrypted when key is non-nil. Wrap is
+// server-side only: it always waits for a ClientHello first. The client
+// side of the handshake is DialClientHello.
+func (t TLSObfs) Wrap(conn net.Conn, key []byte) (net.Conn, error) {
+	if err := serverFakeHandshake(conn); err != nil {
+		return nil, errors.Wrap(err, "fake TLS handshake")
+	}
+	// framed sits directly on the raw conn so every Write it does lands on
+	// the wire shaped like a TLS application-data record; AEAD, when
+	// requested, wraps framed rather than conn so the record *payloads*
+	// are what's actually encrypted, not the record framing itself.
+	var framed net.Conn = &tlsRecordConn{Conn: conn}
+	if len(key) > 0 {
+		encrypted, err := crypto.NewCryptoConn(framed, key)
+		if err != nil {
+			return nil, errors.Wrap(err, "crypto.NewCryptoConn")
+		}
+		framed = encrypted
+	}
+	return framed, nil
+}
+
+// DialClientHello performs the client side of the fake handshake against
+// addr and returns the raw conn; it does not apply the application-data
+// record framing or AEAD that Wrap applies on the server side.
+func DialClientHello(addr, sni string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := clientFakeHandshake(conn, sni); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "fake TLS handshake")
+	}
+	return conn, nil
+}
+
+const (
+	recHandshake  = 0x16
+	recChangeCS   = 0x14
+	recAppData    = 0x17
+	tls12Major    = 0x03
+	tls12Minor    = 0x03
+	maxRecordSize = 1 << 14
+)
+
+func writeRecord(w io.Writer, recordType byte, payload []byte) error {
+	header := make([]byte, 5)
+	header[0] = recordType
+	header[1] = tls12Major
+	header[2] = tls12Minor
+	binary.BigEndian.PutUint16(header[3:], uint16(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readRecord(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint16(header[3:])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+func randomPayload(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// clientFakeHandshake sends a ClientHello-shaped record (carrying sni as a
+// fake SNI extension blob) and consumes the server's ServerHello,
+// ChangeCipherSpec and Finished records.
+func clientFakeHandshake(conn net.Conn, sni string) error {
+	hello := append([]byte(sni), randomPayload(32)...)
+	if err := writeRecord(conn, recHandshake, hello); err != nil {
+		return err
+	}
+	if _, _, err := readRecord(conn); err != nil { // ServerHello
+		return err
+	}
+	if _, _, err := readRecord(conn); err != nil { // ChangeCipherSpec
+		return err
+	}
+	if _, _, err := readRecord(conn); err != nil { // Finished
+		return err
+	}
+	return writeRecord(conn, recChangeCS, []byte{0x01})
+}
+
+// serverFakeHandshake consumes the client's ClientHello and responds with a
+// ServerHello, ChangeCipherSpec and Finished, then waits for the client's
+// ChangeCipherSpec before handing the conn back as app-data framed.
+func serverFakeHandshake(conn net.Conn) error {
+	if _, _, err := readRecord(conn); err != nil { // ClientHello
+		return err
+	}
+	if err := writeRecord(conn, recHandshake, randomPayload(64)); err != nil { // ServerHello
+		return err
+	}
+	if err := writeRecord(conn, recChangeCS, []byte{0x01}); err != nil {
+		return err
+	}
+	if err := writeRecord(conn, recHandshake, randomPayload(32)); err != nil { // Finished
+		return err
+	}
+	_, _, err := readRecord(conn) // client's ChangeCipherSpec
+	return err
+}
+
+// tlsRecordConn frames Read/Write as TLS application-data records over the
+// wrapped conn, buffering partially consumed records.
+type tlsRecordConn struct {
+	net.Conn
+	pending []byte
+}
+
+func (c *tlsRecordConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		_, payload, err := readRecord(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = payload
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *tlsRecordConn) Write(b []byte) (int, error) {
+	total := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxRecordSize {
+			chunk = chunk[:maxRecordSize]
+		}
+		if err := writeRecord(c.Conn, recAppData, chunk); err != nil {
+			return total, err
+		}
+		total += len(chunk)
+		b = b[len(chunk):]
+	}
+	return total, nil
+}
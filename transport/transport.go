@@ -0,0 +1,125 @@
+// Package transport abstracts the connection a pipe/control channel is
+// carried over, so the AEAD encryption previously hardcoded into
+// PipeHandShake is just one of several pluggable Transports.
+package transport
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Transport dials, listens and wraps a raw net.Conn in whatever framing or
+// obfuscation it implements.
+type Transport interface {
+	Name() string
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+	// Wrap wraps conn, using key as the session key for transports that
+	// encrypt (key is ignored by transports that don't).
+	Wrap(conn net.Conn, key []byte) (net.Conn, error)
+}
+
+var registry = make(map[string]Transport)
+
+// Register adds a Transport under name, so it can later be selected by
+// config or detected on the wire.
+func Register(t Transport) {
+	registry[t.Name()] = t
+}
+
+// Get looks up a previously registered Transport by name.
+func Get(name string) (Transport, error) {
+	t, ok := registry[name]
+	if !ok {
+		return nil, errors.Errorf("transport: unknown transport %q", name)
+	}
+	return t, nil
+}
+
+func init() {
+	Register(Plain{})
+	Register(AEAD{})
+	Register(TLSObfs{})
+}
+
+// tlsobfs needs no tag of its own: its fake ClientHello already starts with
+// the TLS record header (0x16, 0x03, ...), which is what Dispatch sniffs
+// for. plain and aead both produce data that's opaque to a first-byte
+// sniff (plaintext protocol bytes and AEAD ciphertext can both start with
+// anything), so a dialer using either of them must prefix the connection
+// with one of these one-byte tags before sending anything else, and
+// Dispatch consumes that tag to tell them apart.
+const (
+	tagPlain byte = 0x00
+	tagAEAD  byte = 0x01
+)
+
+// WriteTag writes the one-byte transport tag a dialer must send before any
+// other data when using the plain or aead transports (tlsobfs needs none).
+func WriteTag(conn net.Conn, name string) error {
+	var tag byte
+	switch name {
+	case "plain":
+		tag = tagPlain
+	case "aead":
+		tag = tagAEAD
+	default:
+		return nil
+	}
+	_, err := conn.Write([]byte{tag})
+	return errors.Wrap(err, "write transport tag")
+}
+
+// sniffLen is the number of leading bytes Dispatch peeks at to recognize a
+// transport's framing before handing the connection off.
+const sniffLen = 3
+
+// Dispatch peeks at the first bytes of conn to pick which registered
+// Transport produced it, then returns conn wrapped accordingly. It's used
+// on the server side, where the accept loop doesn't otherwise know which
+// transport a given client picked.
+func Dispatch(conn net.Conn) (net.Conn, Transport, error) {
+	br := bufio.NewReaderSize(conn, 4096)
+	head, err := br.Peek(sniffLen)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "peek first record")
+	}
+	if looksLikeTLSRecord(head) {
+		t := registry["tlsobfs"]
+		wrapped, err := t.Wrap(&peekedConn{Conn: conn, r: br}, nil)
+		return wrapped, t, err
+	}
+
+	tag, err := br.ReadByte()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read transport tag")
+	}
+	peeked := &peekedConn{Conn: conn, r: br}
+	switch tag {
+	case tagPlain:
+		t := registry["plain"]
+		wrapped, err := t.Wrap(peeked, nil)
+		return wrapped, t, err
+	case tagAEAD:
+		t := registry["aead"]
+		wrapped, err := t.Wrap(peeked, nil)
+		return wrapped, t, err
+	default:
+		return nil, nil, errors.Errorf("transport: unrecognized transport tag %#x", tag)
+	}
+}
+
+func looksLikeTLSRecord(head []byte) bool {
+	return len(head) >= 3 && head[0] == 0x16 && head[1] == 0x03
+}
+
+// peekedConn lets Dispatch hand a conn back to its caller after peeking a
+// few bytes off it, without losing them.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (p *peekedConn) Read(b []byte) (int, error) { return p.r.Read(b) }